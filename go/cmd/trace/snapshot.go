@@ -0,0 +1,59 @@
+package trace
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/lunixbochs/usercorn/go/models/trace"
+)
+
+// Snapshot implements `usercorn trace snapshot <file> <ins#>`: it replays
+// <file> up to instruction <ins#> and writes a Replay snapshot
+// (trace.SaveSnapshot) next to it, so a long trace can be resumed, shared
+// with another developer, or fed into a fresh unicorn instance for
+// divergence checking without re-running the emulator from scratch.
+func Snapshot(args []string) error {
+	fs := flag.NewFlagSet("trace snapshot", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: usercorn trace snapshot <file> <ins#>")
+	}
+	path := fs.Arg(0)
+	ins, err := strconv.ParseUint(fs.Arg(1), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid instruction count %q: %w", fs.Arg(1), err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec, err := trace.NewDecoder(f)
+	if err != nil {
+		return err
+	}
+	rep := trace.NewReplay(dec.Arch, dec.OS, dec.Order, dec.Debug)
+	for rep.Inscount < ins {
+		op, err := dec.Next()
+		if err != nil {
+			return fmt.Errorf("%s: reached end of trace before instruction %d: %w", path, ins, err)
+		}
+		rep.Feed(op)
+	}
+
+	outPath := fmt.Sprintf("%s.ins%d.snap", path, ins)
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := rep.SaveSnapshot(out); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "wrote snapshot at instruction %d to %s\n", ins, outPath)
+	return nil
+}
@@ -0,0 +1,167 @@
+package trace
+
+import "github.com/lunixbochs/usercorn/go/models"
+
+// Operand describes one operand of a decoded instruction, in source order.
+type Operand struct {
+	Text  string // formatted operand, e.g. "eax" or "[ebp-0x8]"
+	Reg   int    // Arch register number if this operand reads or writes a register, else -1
+	Read  bool
+	Write bool
+}
+
+// ControlFlow classifies how a decoded instruction affects PC, so a
+// consumer can tell a branch from straight-line code without re-parsing
+// the mnemonic.
+type ControlFlow int
+
+const (
+	FlowNext   ControlFlow = iota // falls through to the next instruction
+	FlowJump                      // unconditional jump to Target
+	FlowBranch                    // conditional branch to Target (may fall through)
+	FlowCall                      // call to Target, returns
+	FlowReturn                    // returns to caller
+)
+
+// Instruction is the decoded form of one OpStep, as produced by a
+// Disassembler and cached by Replay so repeated visits (loops, rewind) don't
+// re-decode the same bytes.
+type Instruction struct {
+	Addr     uint64
+	Size     uint32
+	Mnemonic string
+	Operands []Operand
+	Flow     ControlFlow
+	Target   uint64 // valid for FlowJump/FlowBranch/FlowCall; always 0 for FlowNext and FlowReturn
+}
+
+// Disassembler decodes a single instruction's bytes starting at pc. It's
+// implemented per-Arch, typically as a fixed opcode table plus operand
+// format descriptors (as used by the SBF/eBPF disassemblers) rather than a
+// general-purpose engine like Capstone, so it can stay in-process and
+// allocation-light on the hot Replay.Feed path.
+type Disassembler interface {
+	Decode(pc uint64, bytes []byte) (mnemonic string, operands []Operand, flow ControlFlow, err error)
+}
+
+// decodeKey identifies a cached Instruction. bytes are hashed rather than
+// kept whole, since Replay only needs to tell "have I decoded exactly this
+// before" apart, not recover the original bytes.
+type decodeKey struct {
+	addr uint64
+	size uint32
+	hash uint64
+}
+
+// fnv1a64 is a tiny, dependency-free hash used to key the decode cache. A
+// cache hit is trusted without comparing bytes, so two different byte
+// sequences at the same addr/size with colliding hashes would share one
+// cached Instruction.
+func fnv1a64(b []byte) uint64 {
+	const offset64 = 14695981039346656037
+	const prime64 = 1099511628211
+	h := uint64(offset64)
+	for _, c := range b {
+		h ^= uint64(c)
+		h *= prime64
+	}
+	return h
+}
+
+// SetDisassembler configures the Disassembler used by decode()/ListenDecoded.
+// It lives on Replay rather than models.Arch: models.Arch is shared,
+// arch-identity state owned by the emulator package, while the decode
+// cache and the rest of ListenDecoded's bookkeeping already live on Replay,
+// so this keeps the whole decode path in one place instead of splitting it
+// across packages. Callers that want the default per-arch disassembler
+// picked for them can use DisassemblerFor(arch.Name).
+func (r *Replay) SetDisassembler(d Disassembler) {
+	r.Disasm = d
+}
+
+// ListenDecoded registers a callback that receives the decoded form of every
+// OpStep alongside the raw Op, so consumers (REPLs, coverage UIs, log
+// tailers) don't each need their own copy of Mem-fetch-and-decode logic.
+// Decoding is skipped (decoded == nil) for ops that aren't OpStep, or when
+// r has no Disassembler configured via SetDisassembler.
+//
+// ListenDecoded wraps Listen, not ListenRewind: it only fires going forward.
+// A StepBack/SeekIns/SeekPC moving backward re-applies ops through
+// emitRewind instead, so a consumer relying solely on ListenDecoded goes
+// silent during a rewind rather than seeing decoded instructions undone in
+// reverse. Register a separate ListenRewind callback (decoding op there with
+// r.decode, same as this one does internally) if that matters.
+func (r *Replay) ListenDecoded(cb func(op models.Op, effects []models.Op, decoded *Instruction)) {
+	r.Listen(func(op models.Op, effects []models.Op) {
+		cb(op, effects, r.decode(op))
+	})
+}
+
+// decode returns the cached/decoded Instruction for op if it's an OpStep and
+// r.Disasm is set, else nil.
+func (r *Replay) decode(op models.Op) *Instruction {
+	step, ok := op.(*OpStep)
+	if !ok || r.Disasm == nil {
+		return nil
+	}
+	data := r.Mem.MemRead(step.Addr, uint64(step.Size))
+	key := decodeKey{addr: step.Addr, size: uint32(step.Size), hash: fnv1a64(data)}
+	if r.decodeCache == nil {
+		r.decodeCache = make(map[decodeKey]*Instruction)
+	}
+	if ins, ok := r.decodeCache[key]; ok {
+		return ins
+	}
+	mnemonic, operands, flow, err := r.Disasm.Decode(step.Addr, data)
+	if err != nil {
+		return nil
+	}
+	ins := &Instruction{
+		Addr:     step.Addr,
+		Size:     uint32(step.Size),
+		Mnemonic: mnemonic,
+		Operands: operands,
+		Flow:     flow,
+		Target:   branchTarget(flow, operands),
+	}
+	r.decodeCache[key] = ins
+	return ins
+}
+
+// branchTarget extracts a jump/call/branch target address from a decoded
+// instruction's operands, by convention the final operand when it's an
+// immediate (Reg == -1, not a memory reference). Returns 0 if flow is
+// FlowNext/FlowReturn or no such operand is present.
+func branchTarget(flow ControlFlow, operands []Operand) uint64 {
+	if flow == FlowNext || flow == FlowReturn || len(operands) == 0 {
+		return 0
+	}
+	last := operands[len(operands)-1]
+	if last.Reg != -1 {
+		return 0
+	}
+	return parseHexAddr(last.Text)
+}
+
+// parseHexAddr parses a "0x..."-formatted address, returning 0 on failure.
+func parseHexAddr(s string) uint64 {
+	if len(s) < 3 || s[0] != '0' || (s[1] != 'x' && s[1] != 'X') {
+		return 0
+	}
+	var v uint64
+	for _, c := range s[2:] {
+		var d uint64
+		switch {
+		case c >= '0' && c <= '9':
+			d = uint64(c - '0')
+		case c >= 'a' && c <= 'f':
+			d = uint64(c-'a') + 10
+		case c >= 'A' && c <= 'F':
+			d = uint64(c-'A') + 10
+		default:
+			return 0
+		}
+		v = v<<4 | d
+	}
+	return v
+}
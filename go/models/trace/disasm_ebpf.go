@@ -0,0 +1,129 @@
+package trace
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// EBPFDisassembler decodes the fixed 8-byte eBPF instruction encoding
+// (opcode, dst:4|src:4, offset int16, imm int32) without a general-purpose
+// engine like Capstone, using two 16-entry mnemonic tables keyed by the
+// operation field (high 4 bits) of the opcode: one for ALU/ALU64, one for
+// JMP/JMP32. Loads and stores decode only as a generic "ld"/"st" with their
+// two registers; their size, mode and offset are not decoded. It implements
+// Disassembler.
+type EBPFDisassembler struct{}
+
+// eBPF instruction class, the low 3 bits of the opcode byte.
+const (
+	ebpfClassLD    = 0x00
+	ebpfClassLDX   = 0x01
+	ebpfClassST    = 0x02
+	ebpfClassSTX   = 0x03
+	ebpfClassALU   = 0x04
+	ebpfClassJMP   = 0x05
+	ebpfClassJMP32 = 0x06
+	ebpfClassALU64 = 0x07
+)
+
+// ebpfAluOp maps the high 4 bits of an ALU/ALU64 opcode to its mnemonic.
+var ebpfAluOp = [16]string{
+	0x0: "add", 0x1: "sub", 0x2: "mul", 0x3: "div",
+	0x4: "or", 0x5: "and", 0x6: "lsh", 0x7: "rsh",
+	0x8: "neg", 0x9: "mod", 0xa: "xor", 0xb: "mov",
+	0xc: "arsh", 0xd: "end",
+}
+
+// ebpfJmpOp maps the high 4 bits of a JMP/JMP32 opcode to its mnemonic.
+var ebpfJmpOp = [16]string{
+	0x0: "ja", 0x1: "jeq", 0x2: "jgt", 0x3: "jge",
+	0x4: "jset", 0x5: "jne", 0x6: "jsgt", 0x7: "jsge",
+	0x8: "call", 0x9: "exit", 0xa: "jlt", 0xb: "jle",
+	0xc: "jslt", 0xd: "jsle",
+}
+
+// ebpfReg names the 11 general-purpose eBPF registers (r0-r10).
+func ebpfReg(n byte) string {
+	if n <= 10 {
+		return fmt.Sprintf("r%d", n)
+	}
+	return fmt.Sprintf("r?%d", n)
+}
+
+func (EBPFDisassembler) Decode(pc uint64, b []byte) (string, []Operand, ControlFlow, error) {
+	if len(b) < 8 {
+		return "", nil, FlowNext, fmt.Errorf("ebpf: need 8 bytes, got %d", len(b))
+	}
+	op := b[0]
+	dst := b[1] & 0x0f
+	src := (b[1] >> 4) & 0x0f
+	off := int16(binary.LittleEndian.Uint16(b[2:4]))
+	imm := int32(binary.LittleEndian.Uint32(b[4:8]))
+	class := op & 0x07
+
+	switch class {
+	case ebpfClassALU, ebpfClassALU64:
+		name := ebpfAluOp[(op>>4)&0x0f]
+		if name == "" {
+			return "", nil, FlowNext, fmt.Errorf("ebpf: unknown alu op %#x", op)
+		}
+		if class == ebpfClassALU64 {
+			name += "64"
+		}
+		dstOp := Operand{Text: ebpfReg(dst), Reg: int(dst), Read: true, Write: true}
+		if op&0x08 != 0 { // BPF_X: source is a register
+			return name, []Operand{dstOp, {Text: ebpfReg(src), Reg: int(src), Read: true}}, FlowNext, nil
+		}
+		return name, []Operand{dstOp, {Text: fmt.Sprintf("%#x", imm), Reg: -1}}, FlowNext, nil
+
+	case ebpfClassJMP, ebpfClassJMP32:
+		name := ebpfJmpOp[(op>>4)&0x0f]
+		if name == "" {
+			return "", nil, FlowNext, fmt.Errorf("ebpf: unknown jmp op %#x", op)
+		}
+		switch name {
+		case "exit":
+			return name, nil, FlowReturn, nil
+		case "call":
+			return name, []Operand{{Text: fmt.Sprintf("%#x", imm), Reg: -1}}, FlowCall, nil
+		case "ja":
+			target := pc + 8 + uint64(off)*8
+			return name, []Operand{{Text: fmt.Sprintf("%#x", target), Reg: -1}}, FlowJump, nil
+		default:
+			target := pc + 8 + uint64(off)*8
+			dstOp := Operand{Text: ebpfReg(dst), Reg: int(dst), Read: true}
+			var srcOp Operand
+			if op&0x08 != 0 {
+				srcOp = Operand{Text: ebpfReg(src), Reg: int(src), Read: true}
+			} else {
+				srcOp = Operand{Text: fmt.Sprintf("%#x", imm), Reg: -1}
+			}
+			return name, []Operand{dstOp, srcOp, {Text: fmt.Sprintf("%#x", target), Reg: -1}}, FlowBranch, nil
+		}
+
+	case ebpfClassLD, ebpfClassLDX:
+		return "ld", []Operand{
+			{Text: ebpfReg(dst), Reg: int(dst), Write: true},
+			{Text: ebpfReg(src), Reg: int(src), Read: true},
+		}, FlowNext, nil
+
+	case ebpfClassST, ebpfClassSTX:
+		return "st", []Operand{
+			{Text: ebpfReg(dst), Reg: int(dst), Read: true},
+			{Text: ebpfReg(src), Reg: int(src), Read: true},
+		}, FlowNext, nil
+	}
+	return "", nil, FlowNext, fmt.Errorf("ebpf: unknown class %#x", class)
+}
+
+// DisassemblerFor returns the built-in Disassembler for archName, or nil if
+// none is registered. Replay.SetDisassembler(DisassemblerFor(r.Arch.Name))
+// is the common wiring; archName values match models.Arch.Name.
+func DisassemblerFor(archName string) Disassembler {
+	switch archName {
+	case "sbf", "ebpf", "bpf":
+		return EBPFDisassembler{}
+	default:
+		return nil
+	}
+}
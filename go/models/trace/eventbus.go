@@ -0,0 +1,334 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/lunixbochs/usercorn/go/models"
+)
+
+// Event is what Subscribe delivers: one op plus the side-effects Flush()
+// attributed to it, stamped with the Inscount/PC it landed at so a remote
+// or buffered consumer can make sense of it without replaying state.
+type Event struct {
+	Inscount uint64
+	PC       uint64
+	Op       models.Op
+	Effects  []models.Op
+}
+
+// EventFilter narrows a subscription down to the ops a consumer actually
+// cares about. A zero-value EventFilter matches everything. Non-empty
+// fields are ANDed together; the PC range [PCLo, PCHi) and the memory range
+// [MemLo, MemHi) are both half-open.
+//
+// Kinds and the memory range are matched against Event.Op only, never
+// against Event.Effects. The memory range rejects only an Event whose Op is
+// an OpMemWrite outside it; every other Event passes it. Emit, as called by
+// Feed/Flush and seeks, publishes only OpStep, OpJmp and OpSyscall as
+// Event.Op, so side effects such as OpMemWrite arrive inside Effects, where
+// neither Kinds nor the memory range looks at them.
+type EventFilter struct {
+	Kinds []string // e.g. "OpStep", "OpMemWrite"; empty matches all op kinds
+	PCLo  uint64
+	PCHi  uint64 // PCLo == PCHi disables the PC range check
+	MemLo uint64
+	MemHi uint64 // MemLo == MemHi disables the memory range check
+}
+
+func (f EventFilter) match(ev Event) bool {
+	if len(f.Kinds) > 0 && !kindIn(ev.Op, f.Kinds) {
+		return false
+	}
+	if f.PCHi > f.PCLo && (ev.PC < f.PCLo || ev.PC >= f.PCHi) {
+		return false
+	}
+	if f.MemHi > f.MemLo {
+		if mw, ok := ev.Op.(*OpMemWrite); ok {
+			end := mw.Addr + uint64(len(mw.Data))
+			if end <= f.MemLo || mw.Addr >= f.MemHi {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func kindIn(op models.Op, kinds []string) bool {
+	name := opKind(op)
+	for _, k := range kinds {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
+
+func opKind(op models.Op) string {
+	switch op.(type) {
+	case *OpStep:
+		return "OpStep"
+	case *OpJmp:
+		return "OpJmp"
+	case *OpReg:
+		return "OpReg"
+	case *OpSpReg:
+		return "OpSpReg"
+	case *OpMemMap:
+		return "OpMemMap"
+	case *OpMemUnmap:
+		return "OpMemUnmap"
+	case *OpMemProt:
+		return "OpMemProt"
+	case *OpMemWrite:
+		return "OpMemWrite"
+	case *OpSyscall:
+		return "OpSyscall"
+	case *OpKeyframe:
+		return "OpKeyframe"
+	case *OpSnapshot:
+		return "OpSnapshot"
+	default:
+		return "Op"
+	}
+}
+
+// DeliveryMode controls what Subscribe does when a consumer can't keep up.
+type DeliveryMode int
+
+const (
+	// DeliverSync blocks Emit until every subscriber's channel has room.
+	// Use for consumers that must never miss an event (e.g. a watchpoint
+	// engine) and are known to be fast.
+	DeliverSync DeliveryMode = iota
+	// DeliverDropOldest is a buffered channel that, once full, discards the
+	// oldest queued event to make room for the new one. Use for UIs and
+	// dashboards where only the latest state matters.
+	DeliverDropOldest
+	// DeliverBlock is a buffered channel that applies backpressure once
+	// full, blocking Emit like DeliverSync but absorbing short bursts.
+	DeliverBlock
+)
+
+// subscriberBuffer is how many events DeliverDropOldest/DeliverBlock buffer
+// before dropping or blocking.
+const subscriberBuffer = 256
+
+// CancelFunc unregisters a subscription. It's safe to call more than once.
+type CancelFunc func()
+
+type subscriber struct {
+	filter EventFilter
+	mode   DeliveryMode
+	ch     chan Event
+	mu     sync.Mutex
+	closed bool
+}
+
+// send delivers ev to s.ch according to s.mode. It holds s.mu for the
+// entire send, not just the closed check, so cancel() (which also takes
+// s.mu before closing s.ch) can never run between "we decided s isn't
+// closed" and "we write to s.ch" — that gap used to let a concurrent
+// cancel() (e.g. a ServeTrace client disconnecting) close the channel out
+// from under an in-flight send, panicking the whole process on "send on
+// closed channel". DeliverSync/DeliverBlock can still block here if the
+// consumer stalls, same as before; that's the documented tradeoff of those
+// two modes.
+func (s *subscriber) send(ev Event) {
+	if !s.filter.match(ev) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	switch s.mode {
+	case DeliverDropOldest:
+		for {
+			select {
+			case s.ch <- ev:
+				return
+			default:
+			}
+			select {
+			case <-s.ch:
+			default:
+			}
+		}
+	default: // DeliverSync, DeliverBlock
+		s.ch <- ev
+	}
+}
+
+func (s *subscriber) cancel() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
+}
+
+// Subscribe returns a channel of Events matching filter, delivered
+// according to mode, and a CancelFunc to unregister and close the channel.
+// Unlike Listen, a slow DeliverDropOldest consumer can't stall the rest of
+// the replay: it sits behind a buffer that drops its oldest events when
+// full. DeliverBlock absorbs bursts up to subscriberBuffer events and then
+// blocks Emit until the consumer catches up; DeliverSync blocks Emit on
+// every event (for consumers that must see every event in order).
+//
+// Like Listen (and unlike ListenRewind), Subscribe only ever sees ops
+// applied going forward: publish is called from Emit, which rebuildTo never
+// calls while re-applying ops during a backward seek (it calls emitRewind
+// instead). A Subscribe consumer sees a gap rather than a reverse stream of
+// Events across a StepBack/SeekIns/SeekPC to an earlier instruction.
+func (r *Replay) Subscribe(filter EventFilter, mode DeliveryMode) (<-chan Event, CancelFunc) {
+	buf := 0
+	if mode != DeliverSync {
+		buf = subscriberBuffer
+	}
+	sub := &subscriber{filter: filter, mode: mode, ch: make(chan Event, buf)}
+	r.subMu.Lock()
+	r.subs = append(r.subs, sub)
+	r.subMu.Unlock()
+	return sub.ch, func() {
+		r.subMu.Lock()
+		for i, s := range r.subs {
+			if s == sub {
+				r.subs = append(r.subs[:i], r.subs[i+1:]...)
+				break
+			}
+		}
+		r.subMu.Unlock()
+		sub.cancel()
+	}
+}
+
+// publish fans an Emit()ted op out to every Subscribe()r, in addition to
+// the legacy callbacks list. Called from Emit so Listen and Subscribe see
+// the same events in the same order.
+func (r *Replay) publish(op models.Op, effects []models.Op) {
+	r.subMu.Lock()
+	subs := append([]*subscriber{}, r.subs...)
+	r.subMu.Unlock()
+	if len(subs) == 0 {
+		return
+	}
+	ev := Event{Inscount: r.Inscount, PC: r.PC, Op: op, Effects: effects}
+	for _, s := range subs {
+		s.send(ev)
+	}
+}
+
+// EncodeNDJSON writes ev to w as one line of newline-delimited JSON,
+// suitable for a log tee or a simple HTTP streaming client.
+func EncodeNDJSON(w *bufio.Writer, ev Event) error {
+	enc := jsonEvent{Inscount: ev.Inscount, PC: ev.PC, Kind: opKind(ev.Op), Op: ev.Op, Effects: ev.Effects}
+	b, err := json.Marshal(enc)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	if err := w.WriteByte('\n'); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+type jsonEvent struct {
+	Inscount uint64      `json:"inscount"`
+	PC       uint64      `json:"pc"`
+	Kind     string      `json:"kind"`
+	Op       models.Op   `json:"op"`
+	Effects  []models.Op `json:"effects,omitempty"`
+}
+
+// EncodeFramed writes ev to w as a length-prefixed protobuf-style frame:
+// a big-endian uint32 length followed by that many bytes of payload. The
+// payload here is JSON rather than a real protobuf message, since this
+// package has no .proto/generated code to depend on; the framing is what
+// lets a TCP/unix-socket client split the stream, and swapping the payload
+// codec later doesn't change the wire framing.
+func EncodeFramed(w *bufio.Writer, ev Event) error {
+	enc := jsonEvent{Inscount: ev.Inscount, PC: ev.PC, Kind: opKind(ev.Op), Op: ev.Op, Effects: ev.Effects}
+	b, err := json.Marshal(enc)
+	if err != nil {
+		return err
+	}
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(b)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// ServeTrace accepts client connections on l and streams every subsequent
+// Replay event to each of them framed (EncodeFramed), until l is closed.
+// Each client gets its own EventFilter read as the first framed message it
+// sends (an empty/unparseable filter means "everything"), so one Replay
+// can drive several remote UIs or fuzzing harnesses with different views
+// of the same run without recompiling anything.
+func (r *Replay) ServeTrace(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go r.serveClient(conn)
+	}
+}
+
+func (r *Replay) serveClient(conn net.Conn) {
+	defer conn.Close()
+	filter := readClientFilter(conn)
+	ch, cancel := r.Subscribe(filter, DeliverDropOldest)
+	defer cancel()
+	bw := bufio.NewWriter(conn)
+	for ev := range ch {
+		if err := EncodeFramed(bw, ev); err != nil {
+			return
+		}
+	}
+}
+
+// maxFilterFrame bounds the length prefix readClientFilter will honor. An
+// EventFilter is a handful of ints and short strings; anything claiming to
+// be bigger than this is either a misbehaving client or a hostile one
+// trying to force a multi-GB allocation before a single byte of the
+// payload has even been validated, so it's rejected outright.
+const maxFilterFrame = 1 << 20 // 1MB
+
+// readClientFilter reads one framed EventFilter JSON message from conn. A
+// read error, an oversized length prefix, or a malformed payload is all
+// treated as "no filter" (match everything) rather than dropping the
+// client.
+func readClientFilter(conn net.Conn) EventFilter {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		return EventFilter{}
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if n > maxFilterFrame {
+		return EventFilter{}
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return EventFilter{}
+	}
+	var f EventFilter
+	if err := json.Unmarshal(buf, &f); err != nil {
+		return EventFilter{}
+	}
+	return f
+}
@@ -0,0 +1,59 @@
+package trace
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/lunixbochs/usercorn/go/models"
+	"github.com/lunixbochs/usercorn/go/models/debug"
+)
+
+// TestSubscribeDropOldest checks that a DeliverDropOldest subscriber never
+// blocks Emit, and that once its buffer fills it keeps the most recent
+// events, discarding the oldest ones rather than the newest.
+func TestSubscribeDropOldest(t *testing.T) {
+	rep := NewReplay(testArch(), &models.OS{}, binary.LittleEndian, &debug.Debug{})
+	ch, cancel := rep.Subscribe(EventFilter{}, DeliverDropOldest)
+	defer cancel()
+
+	const total = subscriberBuffer + 50
+	for i := 0; i < total; i++ {
+		rep.Feed(&OpStep{Addr: uint64(i), Size: 1})
+	}
+
+	if got := len(ch); got != subscriberBuffer {
+		t.Fatalf("buffered events: got %d, want %d", got, subscriberBuffer)
+	}
+	wantFirst := uint64(total - subscriberBuffer)
+	if ev := <-ch; ev.Inscount != wantFirst {
+		t.Fatalf("oldest surviving event: got Inscount=%d, want %d (drop-oldest should have discarded everything before it)", ev.Inscount, wantFirst)
+	}
+}
+
+// TestSubscribeCancelRace exercises the race send() was rewritten to close:
+// cancel() closing the subscriber's channel concurrently with Feed()/Emit()
+// delivering to it must never panic with "send on closed channel".
+func TestSubscribeCancelRace(t *testing.T) {
+	rep := NewReplay(testArch(), &models.OS{}, binary.LittleEndian, &debug.Debug{})
+	ch, cancel := rep.Subscribe(EventFilter{}, DeliverDropOldest)
+
+	feedDone := make(chan struct{})
+	go func() {
+		defer close(feedDone)
+		for i := 0; i < 2000; i++ {
+			rep.Feed(&OpStep{Addr: uint64(i), Size: 1})
+		}
+	}()
+	drainDone := make(chan struct{})
+	go func() {
+		defer close(drainDone)
+		for range ch {
+		}
+	}()
+
+	time.Sleep(time.Millisecond)
+	cancel()
+	<-feedDone
+	<-drainDone
+}
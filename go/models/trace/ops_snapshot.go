@@ -0,0 +1,13 @@
+package trace
+
+// OpSnapshot carries a full Replay checkpoint embedded inline in a
+// .uctrace stream, produced by Replay.SaveSnapshot and consumed by
+// Replay.Feed (which hands it to restoreFromBytes). Unlike OpKeyframe,
+// which replays as a list of state-change Ops, OpSnapshot's Data is the
+// same framed/compressed format SaveSnapshot writes and LoadSnapshot
+// reads, so a tracer can drop a full checkpoint into the stream at
+// whatever interval it likes without the consumer needing a separate
+// snapshot file to resume from.
+type OpSnapshot struct {
+	Data []byte
+}
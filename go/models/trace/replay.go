@@ -2,6 +2,7 @@ package trace
 
 import (
 	"encoding/binary"
+	"sync"
 
 	"github.com/lunixbochs/usercorn/go/models"
 	"github.com/lunixbochs/usercorn/go/models/cpu"
@@ -16,13 +17,69 @@ type Replay struct {
 	SpRegs map[int][]byte
 	PC, SP uint64
 
+	// order is kept from NewReplay so a seek can rebuild Mem from scratch.
+	order binary.ByteOrder
+
 	Callstack models.Callstack
 	Debug     *debug.Debug
 	Inscount  uint64
 	// pending is an OpStep representing the last unflushed instruction. Cleared by Flush().
-	pending   *OpStep
-	effects   []models.Op
-	callbacks []func(models.Op, []models.Op)
+	pending         *OpStep
+	effects         []models.Op
+	callbacks       []func(models.Op, []models.Op)
+	rewindCallbacks []func(models.Op, []models.Op)
+
+	// KeyframeInterval is the maximum number of instructions Replay will let
+	// pass before asking the tracer (via ForceKeyframe) to emit a fresh
+	// OpKeyframe, bounding how far Step/SeekIns/SeekPC have to replay to
+	// satisfy a seek. Zero disables the hook; Replay still works, seeks just
+	// degrade toward replaying from the nearest keyframe actually present.
+	KeyframeInterval uint64
+	// ForceKeyframe, if set, is called when Inscount - last keyframe's
+	// Inscount reaches KeyframeInterval. The tracer is expected to respond by
+	// feeding an OpKeyframe on its next opportunity.
+	ForceKeyframe func(r *Replay)
+
+	// keyframes holds every OpKeyframe snapshot seen so far, in order, used
+	// as restore points when seeking.
+	keyframes []keyframeSnapshot
+	// log records every instruction Flush()ed so far, tagged with the
+	// Inscount and PC it landed at, so a seek can replay forward from the
+	// nearest keyframe without re-running the whole trace from instruction 0.
+	log []loggedOp
+
+	// Disasm decodes OpStep bytes for ListenDecoded, if set via
+	// SetDisassembler. Nil means decode() is a no-op.
+	Disasm Disassembler
+	// decodeCache holds already-decoded instructions keyed by address, size
+	// and a hash of their bytes, so loops and rewinds don't pay for
+	// re-decoding the same instruction over and over.
+	decodeCache map[decodeKey]*Instruction
+
+	// subs holds every active Subscribe()r, guarded by subMu since
+	// ServeTrace's client goroutines register/cancel concurrently with
+	// Feed()/Emit() running on whatever goroutine drives the replay.
+	subMu sync.Mutex
+	subs  []*subscriber
+
+	// watch/break state; see watch.go. watchMu guards memWatches, regWatches,
+	// breaks, watchSeq, breakSeq and hitLog, since AddWatch/AddRegWatch/
+	// AddBreak/NextHit/PrevHit can be called from a REPL or control
+	// goroutine concurrently with Feed() driving checkWatches.
+	watchMu    sync.Mutex
+	memWatches []*memWatch
+	regWatches []*regWatch
+	breaks     []*breakpoint
+	watchSeq   int
+	breakSeq   int
+	hits       chan HitEvent
+	hitLog     []HitEvent
+	// seeking suppresses watch/break delivery while rebuildTo() is
+	// re-applying already-seen ops to restore state after a keyframe, so a
+	// backward seek doesn't re-fire every hit between the keyframe and the
+	// target. A forward seek (seekForward) doesn't set it, so hits between
+	// the old and new position are delivered again.
+	seeking bool
 }
 
 func NewReplay(arch *models.Arch, os *models.OS, order binary.ByteOrder, dbg *debug.Debug) *Replay {
@@ -33,6 +90,7 @@ func NewReplay(arch *models.Arch, os *models.OS, order binary.ByteOrder, dbg *de
 		Regs:   make(map[int]uint64),
 		SpRegs: make(map[int][]byte),
 		Debug:  dbg,
+		order:  order,
 	}
 }
 
@@ -76,6 +134,9 @@ func (r *Replay) update(op models.Op) {
 			r.update(v)
 		}
 	}
+	if !r.seeking {
+		r.checkWatches(op)
+	}
 }
 
 // Feed() is the entry point handling Op structs.
@@ -91,12 +152,24 @@ func (r *Replay) Feed(op models.Op) {
 	case *OpKeyframe:
 		// we need to flush here, because the keyframe can change state we need to emit
 		r.Flush()
-		// We only need the first keyframe for simple display (until we're doing rewind/ff)
-		// but it probably doesn't hurt too much for now to always process keyframes... just don't emit them
+		r.keyframes = append(r.keyframes, keyframeSnapshot{Inscount: r.Inscount, Ops: o.Ops})
 		for _, v := range o.Ops {
 			r.update(v)
 		}
 		return
+
+	case *OpSnapshot:
+		// like OpKeyframe, a full checkpoint embedded inline in the stream;
+		// unlike OpKeyframe it carries its own framed/compressed bytes
+		// rather than a plain Ops list, so it's applied directly instead of
+		// going through update(). The bytes are kept on the keyframe entry
+		// (kf.Data) too, since rebuildTo can't reconstruct this checkpoint
+		// from an empty Ops list the way it can for a plain OpKeyframe.
+		r.Flush()
+		if err := r.restoreFromBytes(o.Data); err == nil {
+			r.keyframes = append(r.keyframes, keyframeSnapshot{Inscount: r.Inscount, Data: o.Data})
+		}
+		return
 	}
 
 	for _, op := range ops {
@@ -130,11 +203,13 @@ func (r *Replay) Emit(op models.Op, effects []models.Op) {
 	for _, cb := range r.callbacks {
 		cb(op, effects)
 	}
+	r.publish(op, effects)
 }
 
 func (r *Replay) Flush() {
 	if r.pending != nil {
 		r.Emit(r.pending, r.effects)
+		r.log = append(r.log, loggedOp{Inscount: r.Inscount, PC: r.PC, Op: r.pending, Effects: append([]models.Op{}, r.effects...)})
 		r.Inscount += 1
 		r.update(r.pending)
 		for _, op := range r.effects {
@@ -142,6 +217,23 @@ func (r *Replay) Flush() {
 		}
 		r.effects = r.effects[:0]
 		r.pending = nil
+		r.checkKeyframeInterval()
+	}
+}
+
+// checkKeyframeInterval asks the tracer to emit a fresh keyframe once we've
+// drifted KeyframeInterval or more instructions past the last one, so
+// seeks never have to replay an unbounded number of ops.
+func (r *Replay) checkKeyframeInterval() {
+	if r.KeyframeInterval == 0 || r.ForceKeyframe == nil {
+		return
+	}
+	var last uint64
+	if n := len(r.keyframes); n > 0 {
+		last = r.keyframes[n-1].Inscount
+	}
+	if r.Inscount-last >= r.KeyframeInterval {
+		r.ForceKeyframe(r)
 	}
 }
 
@@ -0,0 +1,196 @@
+package trace
+
+import (
+	"github.com/lunixbochs/usercorn/go/models"
+	"github.com/lunixbochs/usercorn/go/models/cpu"
+)
+
+// keyframeSnapshot is a restore point for seeking, recorded as an OpKeyframe
+// or OpSnapshot passes through Feed. OpKeyframe populates Ops, a list of
+// state-change ops to replay via update(); OpSnapshot populates Data, the
+// same framed/compressed bytes restoreFromBytes consumes, since a snapshot
+// doesn't decompose into a list of Ops. rebuildTo prefers Data when present.
+type keyframeSnapshot struct {
+	Inscount uint64
+	Ops      []models.Op
+	Data     []byte
+}
+
+// loggedOp is a single flushed instruction plus the side-effects that were
+// attributed to it. Every flushed instruction since the start of the trace
+// is recorded, so Step/SeekIns/SeekPC can replay forward from a restored
+// snapshot instead of from instruction 0.
+type loggedOp struct {
+	Inscount uint64
+	PC       uint64
+	Op       models.Op
+	Effects  []models.Op
+}
+
+// ListenRewind registers a callback that only fires for ops re-applied while
+// walking backward (StepBack/SeekIns/SeekPC to an earlier instruction). It
+// lets consumers undo UI/highlight state driven by Listen without confusing
+// the two directions on the same channel.
+func (r *Replay) ListenRewind(cb func(models.Op, []models.Op)) {
+	r.rewindCallbacks = append(r.rewindCallbacks, cb)
+}
+
+func (r *Replay) emitRewind(op models.Op, effects []models.Op) {
+	for _, cb := range r.rewindCallbacks {
+		cb(op, effects)
+	}
+}
+
+// reset clears all observable state back to what NewReplay would produce,
+// keeping Arch/OS/Debug/KeyframeInterval/ForceKeyframe, the callbacks
+// already registered, and the recorded keyframes/log. It's the starting
+// point for rebuilding state at an earlier instruction.
+func (r *Replay) reset() {
+	r.Mem = cpu.NewMem(uint(r.Arch.Bits), r.order)
+	r.Regs = make(map[int]uint64)
+	r.SpRegs = make(map[int][]byte)
+	r.PC, r.SP = 0, 0
+	r.Callstack = models.Callstack{}
+	r.Inscount = 0
+	r.pending = nil
+	r.effects = nil
+}
+
+// nearestKeyframe returns the index into r.keyframes of the last keyframe at
+// or before ins, or -1 if ins precedes every recorded keyframe, in which
+// case a seek has to fall back to replaying from instruction 0.
+func (r *Replay) nearestKeyframe(ins uint64) int {
+	best := -1
+	for i, kf := range r.keyframes {
+		if kf.Inscount > ins {
+			break
+		}
+		best = i
+	}
+	return best
+}
+
+// rebuildTo restores Replay to the state immediately before instruction
+// target by resetting to the nearest keyframe at or before target and
+// replaying every logged op from there up to (but not including) target.
+// It's only ever used for backward seeks (SeekIns calls it with
+// emitRewind); a forward seek never needs to discard the live state it
+// already has, so it goes through seekForward instead.
+func (r *Replay) rebuildTo(target uint64, emit func(op models.Op, effects []models.Op)) {
+	r.seeking = true
+	defer func() { r.seeking = false }()
+	idx := r.nearestKeyframe(target)
+	r.reset()
+	if idx >= 0 {
+		kf := r.keyframes[idx]
+		r.Inscount = kf.Inscount
+		if kf.Data != nil {
+			// an OpSnapshot-derived keyframe carries its state as framed
+			// bytes rather than a replayable Ops list; restoreFromBytes puts
+			// Mem/Regs/SpRegs/PC/SP/Callstack/Inscount back exactly as they
+			// were when the snapshot was taken.
+			if err := r.restoreFromBytes(kf.Data); err != nil {
+				r.Inscount = 0
+			}
+		} else {
+			for _, op := range kf.Ops {
+				r.update(op)
+			}
+		}
+	}
+	for _, lo := range r.log {
+		if lo.Inscount < r.Inscount {
+			continue
+		}
+		if lo.Inscount >= target {
+			break
+		}
+		if emit != nil {
+			emit(lo.Op, lo.Effects)
+		}
+		r.update(lo.Op)
+		for _, eff := range lo.Effects {
+			r.update(eff)
+		}
+		r.Inscount = lo.Inscount + 1
+	}
+	r.resyncWatchShadows()
+}
+
+// seekForward walks Replay from its current, already-correct live state up
+// to instruction target, without resetting to a keyframe first. r.log
+// already holds every instruction from the start of the trace, so the
+// entries at or after r.Inscount are exactly the ones not yet applied to
+// the live state. Replaying just those means each Step(1) re-applies one
+// instruction, instead of everything since the nearest keyframe as
+// rebuildTo's reset-and-replay path would. Finding the first unapplied
+// entry is still a linear scan of r.log from its start.
+func (r *Replay) seekForward(target uint64) {
+	for _, lo := range r.log {
+		if lo.Inscount < r.Inscount {
+			continue
+		}
+		if lo.Inscount >= target {
+			break
+		}
+		r.Emit(lo.Op, lo.Effects)
+		r.update(lo.Op)
+		for _, eff := range lo.Effects {
+			r.update(eff)
+		}
+		r.Inscount = lo.Inscount + 1
+	}
+}
+
+// SeekIns moves Replay to stand exactly before instruction ins (i.e. after
+// SeekIns(n), Inscount == n and PC is the address of instruction n). Moving
+// forward replays from the current live state through Listen, since it's
+// already correct up to r.Inscount; it stops at the end of the recorded
+// trace, so for an ins beyond it Inscount ends up at the number of
+// instructions recorded. Moving backward restores the nearest
+// keyframe at or before ins and replays forward from there, firing
+// ListenRewind instead of Listen for every instruction re-applied.
+func (r *Replay) SeekIns(ins uint64) {
+	if ins == r.Inscount {
+		return
+	}
+	if ins > r.Inscount {
+		r.seekForward(ins)
+		return
+	}
+	r.rebuildTo(ins, r.emitRewind)
+}
+
+// SeekPC seeks to the first logged instruction whose PC equals pc, starting
+// the search from the beginning of the trace. It returns false if pc was
+// never recorded.
+func (r *Replay) SeekPC(pc uint64) bool {
+	for _, lo := range r.log {
+		if lo.PC == pc {
+			r.SeekIns(lo.Inscount)
+			return true
+		}
+	}
+	return false
+}
+
+// Step advances Replay forward by n instructions (n <= 0 is a no-op).
+func (r *Replay) Step(n int) {
+	if n <= 0 {
+		return
+	}
+	r.SeekIns(r.Inscount + uint64(n))
+}
+
+// StepBack rewinds Replay by n instructions (n <= 0 is a no-op). Stepping
+// back past instruction 0 clamps to 0.
+func (r *Replay) StepBack(n int) {
+	if n <= 0 {
+		return
+	}
+	if uint64(n) >= r.Inscount {
+		r.SeekIns(0)
+		return
+	}
+	r.SeekIns(r.Inscount - uint64(n))
+}
@@ -0,0 +1,166 @@
+package trace
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/lunixbochs/usercorn/go/models"
+	"github.com/lunixbochs/usercorn/go/models/debug"
+)
+
+func testArch() *models.Arch {
+	return &models.Arch{Bits: 64, SP: 1}
+}
+
+// genTrace builds a deterministic pseudo-random instruction trace: each
+// instruction is an OpStep of random size, occasionally preceded by an
+// OpReg side effect that writes a random register. prefix[i] is the number
+// of leading raw ops that make up exactly the first i+1 instructions, so a
+// linear oracle for instruction count k can replay ops[:prefix[k-1]].
+func genTrace(n int, seed int64) (ops []models.Op, prefix []int) {
+	rng := rand.New(rand.NewSource(seed))
+	var pc uint64
+	for i := 0; i < n; i++ {
+		if rng.Intn(2) == 0 {
+			ops = append(ops, &OpReg{Num: uint32(rng.Intn(4)), Val: rng.Uint64()})
+		}
+		size := uint32(1 + rng.Intn(4))
+		ops = append(ops, &OpStep{Addr: pc, Size: size})
+		pc += uint64(size)
+		prefix = append(prefix, len(ops))
+	}
+	return ops, prefix
+}
+
+// oracleAt linearly replays ops[:prefix[target-1]] into a fresh Replay,
+// which by construction is the ground truth for "state after target
+// instructions" against which a seek on a long-lived Replay is checked.
+func oracleAt(ops []models.Op, prefix []int, target uint64) *Replay {
+	rep := NewReplay(testArch(), &models.OS{}, binary.LittleEndian, &debug.Debug{})
+	if target == 0 {
+		return rep
+	}
+	for _, op := range ops[:prefix[target-1]] {
+		rep.Feed(op)
+	}
+	return rep
+}
+
+func sameState(a, b *Replay) bool {
+	if a.Inscount != b.Inscount || a.PC != b.PC || a.SP != b.SP {
+		return false
+	}
+	if len(a.Regs) != len(b.Regs) {
+		return false
+	}
+	for k, v := range a.Regs {
+		if b.Regs[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// TestSeekFuzzVsOracle fuzzes random forward and backward SeekIns calls on
+// one long-lived Replay, fed the full trace up front (mirroring a tracer
+// that decodes everything before a consumer starts seeking around in it),
+// and checks its state after each seek against a freshly, linearly-replayed
+// oracle for that same instruction count. Forward seeks go through
+// seekForward from the live state and backward seeks through rebuildTo, so
+// both paths are checked for correctness; how long a seek takes is not
+// measured.
+//
+// KeyframeInterval is set but ForceKeyframe isn't, so rep.keyframes stays
+// empty throughout: this exercises rebuildTo's from-scratch fallback path
+// only. TestSeekFuzzVsOracleKeyframeRestore below covers the other branch,
+// where a keyframe is actually present and picked by nearestKeyframe.
+func TestSeekFuzzVsOracle(t *testing.T) {
+	const n = 200
+	ops, prefix := genTrace(n, 1)
+
+	rng := rand.New(rand.NewSource(2))
+	rep := NewReplay(testArch(), &models.OS{}, binary.LittleEndian, &debug.Debug{})
+	rep.KeyframeInterval = 17
+	for _, op := range ops {
+		rep.Feed(op)
+	}
+
+	for step := 0; step < 500; step++ {
+		target := uint64(rng.Intn(n + 1))
+		rep.SeekIns(target)
+
+		want := oracleAt(ops, prefix, target)
+		if !sameState(rep, want) {
+			t.Fatalf("seek %d: got Inscount=%d PC=%#x SP=%#x Regs=%v, want Inscount=%d PC=%#x SP=%#x Regs=%v",
+				target, rep.Inscount, rep.PC, rep.SP, rep.Regs, want.Inscount, want.PC, want.SP, want.Regs)
+		}
+	}
+}
+
+// TestSeekFuzzVsOracleKeyframeRestore is TestSeekFuzzVsOracle with
+// ForceKeyframe actually wired up, so rep.keyframes ends up non-empty and a
+// backward SeekIns can land on one: rebuildTo's restore-from-keyframe branch
+// (not just its from-scratch fallback) gets exercised against the oracle.
+// The keyframe's Ops are built to fully reconstruct PC/Regs/SpRegs from
+// scratch (an OpJmp plus one OpReg/OpSpReg per currently-set register),
+// since unlike the incremental ops genTrace produces, a keyframe has to
+// stand on its own.
+func TestSeekFuzzVsOracleKeyframeRestore(t *testing.T) {
+	const n = 200
+	ops, prefix := genTrace(n, 4)
+
+	rng := rand.New(rand.NewSource(5))
+	rep := NewReplay(testArch(), &models.OS{}, binary.LittleEndian, &debug.Debug{})
+	rep.KeyframeInterval = 17
+	rep.ForceKeyframe = func(r *Replay) {
+		kfOps := []models.Op{&OpJmp{Addr: r.PC}}
+		for num, val := range r.Regs {
+			kfOps = append(kfOps, &OpReg{Num: uint32(num), Val: val})
+		}
+		for num, val := range r.SpRegs {
+			kfOps = append(kfOps, &OpSpReg{Num: uint32(num), Val: append([]byte{}, val...)})
+		}
+		r.Feed(&OpKeyframe{Ops: kfOps})
+	}
+	for _, op := range ops {
+		rep.Feed(op)
+	}
+	if len(rep.keyframes) == 0 {
+		t.Fatal("ForceKeyframe never fired; test doesn't exercise the keyframe-restore path")
+	}
+
+	for step := 0; step < 500; step++ {
+		target := uint64(rng.Intn(n + 1))
+		rep.SeekIns(target)
+
+		want := oracleAt(ops, prefix, target)
+		if !sameState(rep, want) {
+			t.Fatalf("seek %d: got Inscount=%d PC=%#x SP=%#x Regs=%v, want Inscount=%d PC=%#x SP=%#x Regs=%v",
+				target, rep.Inscount, rep.PC, rep.SP, rep.Regs, want.Inscount, want.PC, want.SP, want.Regs)
+		}
+	}
+}
+
+// TestStepStepBack checks Step/StepBack agree with SeekIns for the same
+// target, including clamping StepBack past instruction 0.
+func TestStepStepBack(t *testing.T) {
+	const n = 64
+	ops, prefix := genTrace(n, 3)
+	rep := NewReplay(testArch(), &models.OS{}, binary.LittleEndian, &debug.Debug{})
+	// Step only walks instructions already recorded, so feed the whole
+	// trace first and rewind to the start.
+	for _, op := range ops {
+		rep.Feed(op)
+	}
+	rep.SeekIns(0)
+
+	rep.Step(10)
+	if want := oracleAt(ops, prefix, 10); !sameState(rep, want) {
+		t.Fatalf("Step(10): got Inscount=%d, want %d", rep.Inscount, want.Inscount)
+	}
+	rep.StepBack(100) // clamps to 0
+	if rep.Inscount != 0 {
+		t.Fatalf("StepBack(100) from 10: got Inscount=%d, want 0", rep.Inscount)
+	}
+}
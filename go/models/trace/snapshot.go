@@ -0,0 +1,428 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/lunixbochs/usercorn/go/models"
+	"github.com/lunixbochs/usercorn/go/models/cpu"
+	"github.com/lunixbochs/usercorn/go/models/debug"
+)
+
+// snapshotMagic tags the start of a Replay snapshot stream. The version
+// byte that follows lets LoadSnapshot reject files from an incompatible
+// usercorn without guessing at a partially-decoded frame.
+var snapshotMagic = [4]byte{'U', 'C', 'S', 'N'}
+
+const snapshotVersion = 1
+
+// SaveSnapshot writes the full observable state of r to w: Arch/OS identity,
+// byte order, Regs, SpRegs, PC, SP, Inscount, Callstack, and every mapped
+// page in Mem (including Desc, File and prot bits, contents
+// zlib-compressed). The format is a versioned, framed stream (magic,
+// version, then length-prefixed sections) so a snapshot taken by one
+// usercorn build can be rejected cleanly by an incompatible one instead of
+// being misparsed.
+//
+// SaveSnapshot flushes r first, so an unflushed pending instruction (and
+// the side-effects queued for it) is fully applied to Regs/SpRegs/PC/
+// Inscount/Mem before any of that state is written out, rather than being
+// silently dropped.
+func (r *Replay) SaveSnapshot(w io.Writer) error {
+	r.Flush()
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(snapshotMagic[:]); err != nil {
+		return err
+	}
+	if err := bw.WriteByte(snapshotVersion); err != nil {
+		return err
+	}
+	if err := writeString(bw, r.Arch.Name); err != nil {
+		return err
+	}
+	if err := writeString(bw, r.OS.Name); err != nil {
+		return err
+	}
+	bigEndian := r.order == binary.BigEndian
+	if err := writeBool(bw, bigEndian); err != nil {
+		return err
+	}
+	if err := writeUvarint(bw, r.Inscount); err != nil {
+		return err
+	}
+	if err := writeUvarint(bw, r.PC); err != nil {
+		return err
+	}
+	if err := writeUvarint(bw, r.SP); err != nil {
+		return err
+	}
+	if err := writeRegMap(bw, r.Regs); err != nil {
+		return err
+	}
+	if err := writeSpRegMap(bw, r.SpRegs); err != nil {
+		return err
+	}
+	if err := writeCallstack(bw, r.Callstack); err != nil {
+		return err
+	}
+	if err := writePages(bw, r.Mem); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// LoadSnapshot builds a fresh Replay from a stream written by SaveSnapshot.
+// arch/os/dbg/order are supplied by the caller (mirroring NewReplay) rather
+// than reconstructed from the stream's name strings, since resolving a name
+// back into a *models.Arch is the caller's job, not this package's.
+func LoadSnapshot(r io.Reader, arch *models.Arch, os *models.OS, order binary.ByteOrder, dbg *debug.Debug) (*Replay, error) {
+	br := bufio.NewReader(r)
+	var magic [4]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil {
+		return nil, err
+	}
+	if magic != snapshotMagic {
+		return nil, fmt.Errorf("trace: not a Replay snapshot")
+	}
+	version, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != snapshotVersion {
+		return nil, fmt.Errorf("trace: unsupported snapshot version %d", version)
+	}
+	if _, err := readString(br); err != nil { // arch name, informational only
+		return nil, err
+	}
+	if _, err := readString(br); err != nil { // os name, informational only
+		return nil, err
+	}
+	if _, err := readBool(br); err != nil { // byte order, caller already supplied it
+		return nil, err
+	}
+	rep := NewReplay(arch, os, order, dbg)
+	if rep.Inscount, err = readUvarint(br); err != nil {
+		return nil, err
+	}
+	if rep.PC, err = readUvarint(br); err != nil {
+		return nil, err
+	}
+	if rep.SP, err = readUvarint(br); err != nil {
+		return nil, err
+	}
+	if rep.Regs, err = readRegMap(br); err != nil {
+		return nil, err
+	}
+	if rep.SpRegs, err = readSpRegMap(br); err != nil {
+		return nil, err
+	}
+	if rep.Callstack, err = readCallstack(br); err != nil {
+		return nil, err
+	}
+	if err := readPages(br, rep.Mem); err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+// restoreFromBytes replaces r's state in place from a snapshot written by
+// SaveSnapshot, reusing r's existing Arch/OS/Debug/order: the state is
+// decoded through LoadSnapshot into a temporary Replay and then copied into
+// r, so callers keep the same *Replay. It backs the OpSnapshot op so a .uctrace stream
+// can embed a full checkpoint inline (at whatever interval the tracer
+// chooses) without the consumer having to manage a side-channel file.
+func (r *Replay) restoreFromBytes(data []byte) error {
+	rep, err := LoadSnapshot(bytes.NewReader(data), r.Arch, r.OS, r.order, r.Debug)
+	if err != nil {
+		return err
+	}
+	r.Mem = rep.Mem
+	r.Regs = rep.Regs
+	r.SpRegs = rep.SpRegs
+	r.PC, r.SP = rep.PC, rep.SP
+	r.Callstack = rep.Callstack
+	r.Inscount = rep.Inscount
+	return nil
+}
+
+func writeBool(w io.Writer, v bool) error {
+	var b byte
+	if v {
+		b = 1
+	}
+	_, err := w.Write([]byte{b})
+	return err
+}
+
+func readBool(r io.ByteReader) (bool, error) {
+	b, err := r.ReadByte()
+	return b != 0, err
+}
+
+func writeUvarint(w io.Writer, v uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	_, err := w.Write(buf[:n])
+	return err
+}
+
+func readUvarint(r io.ByteReader) (uint64, error) {
+	return binary.ReadUvarint(r)
+}
+
+func writeBytes(w io.Writer, b []byte) error {
+	if err := writeUvarint(w, uint64(len(b))); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readBytes(r io.Reader, br io.ByteReader) ([]byte, error) {
+	n, err := readUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(r, buf)
+	return buf, err
+}
+
+func writeString(w io.Writer, s string) error {
+	return writeBytes(w, []byte(s))
+}
+
+func readString(br *bufio.Reader) (string, error) {
+	b, err := readBytes(br, br)
+	return string(b), err
+}
+
+func writeRegMap(w io.Writer, regs map[int]uint64) error {
+	if err := writeUvarint(w, uint64(len(regs))); err != nil {
+		return err
+	}
+	for num, val := range regs {
+		if err := writeUvarint(w, uint64(num)); err != nil {
+			return err
+		}
+		if err := writeUvarint(w, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readRegMap(br *bufio.Reader) (map[int]uint64, error) {
+	n, err := readUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	regs := make(map[int]uint64, n)
+	for i := uint64(0); i < n; i++ {
+		num, err := readUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		val, err := readUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		regs[int(num)] = val
+	}
+	return regs, nil
+}
+
+func writeSpRegMap(w io.Writer, regs map[int][]byte) error {
+	if err := writeUvarint(w, uint64(len(regs))); err != nil {
+		return err
+	}
+	for num, val := range regs {
+		if err := writeUvarint(w, uint64(num)); err != nil {
+			return err
+		}
+		if err := writeBytes(w, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSpRegMap(br *bufio.Reader) (map[int][]byte, error) {
+	n, err := readUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	regs := make(map[int][]byte, n)
+	for i := uint64(0); i < n; i++ {
+		num, err := readUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		val, err := readBytes(br, br)
+		if err != nil {
+			return nil, err
+		}
+		regs[int(num)] = val
+	}
+	return regs, nil
+}
+
+// writeCallstack serializes Callstack as its flattened PC/SP frame pairs;
+// models.Callstack doesn't expose more than that to this package, and a
+// resumed replay only needs the frames to keep reporting backtraces.
+func writeCallstack(w io.Writer, cs models.Callstack) error {
+	frames := cs.Frames()
+	if err := writeUvarint(w, uint64(len(frames))); err != nil {
+		return err
+	}
+	for _, f := range frames {
+		if err := writeUvarint(w, f.PC); err != nil {
+			return err
+		}
+		if err := writeUvarint(w, f.SP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readCallstack(br *bufio.Reader) (models.Callstack, error) {
+	var cs models.Callstack
+	n, err := readUvarint(br)
+	if err != nil {
+		return cs, err
+	}
+	for i := uint64(0); i < n; i++ {
+		pc, err := readUvarint(br)
+		if err != nil {
+			return cs, err
+		}
+		sp, err := readUvarint(br)
+		if err != nil {
+			return cs, err
+		}
+		cs.Update(pc, sp)
+	}
+	return cs, nil
+}
+
+// writePages serializes every mapped page in mem: address, size, prot,
+// Desc, optional FileDesc, and its contents compressed with zlib (page
+// contents are frequently all-zero or highly repetitive, so this is cheap
+// and meaningfully shrinks a long-running trace's snapshot).
+func writePages(w io.Writer, mem *cpu.Mem) error {
+	pages := mem.Maps()
+	if err := writeUvarint(w, uint64(len(pages))); err != nil {
+		return err
+	}
+	for _, p := range pages {
+		if err := writeUvarint(w, p.Addr); err != nil {
+			return err
+		}
+		if err := writeUvarint(w, p.Size); err != nil {
+			return err
+		}
+		if err := writeUvarint(w, uint64(p.Prot)); err != nil {
+			return err
+		}
+		if err := writeString(w, p.Desc); err != nil {
+			return err
+		}
+		hasFile := p.File != nil
+		if err := writeBool(w, hasFile); err != nil {
+			return err
+		}
+		if hasFile {
+			if err := writeString(w, p.File.Name); err != nil {
+				return err
+			}
+			if err := writeUvarint(w, p.File.Off); err != nil {
+				return err
+			}
+			if err := writeUvarint(w, p.File.Len); err != nil {
+				return err
+			}
+		}
+		data := mem.MemRead(p.Addr, p.Size)
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		if _, err := zw.Write(data); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		if err := writeBytes(w, compressed.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readPages(br *bufio.Reader, mem *cpu.Mem) error {
+	n, err := readUvarint(br)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < n; i++ {
+		addr, err := readUvarint(br)
+		if err != nil {
+			return err
+		}
+		size, err := readUvarint(br)
+		if err != nil {
+			return err
+		}
+		prot, err := readUvarint(br)
+		if err != nil {
+			return err
+		}
+		desc, err := readString(br)
+		if err != nil {
+			return err
+		}
+		hasFile, err := readBool(br)
+		if err != nil {
+			return err
+		}
+		var file *cpu.FileDesc
+		if hasFile {
+			name, err := readString(br)
+			if err != nil {
+				return err
+			}
+			off, err := readUvarint(br)
+			if err != nil {
+				return err
+			}
+			length, err := readUvarint(br)
+			if err != nil {
+				return err
+			}
+			file = &cpu.FileDesc{Name: name, Off: off, Len: length}
+		}
+		compressed, err := readBytes(br, br)
+		if err != nil {
+			return err
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(zr)
+		zr.Close()
+		if err != nil {
+			return err
+		}
+		page := mem.Sim.Map(addr, size, int(prot), true)
+		page.Desc = desc
+		page.File = file
+		mem.MemWrite(addr, data)
+	}
+	return nil
+}
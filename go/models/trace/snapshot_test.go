@@ -0,0 +1,71 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/lunixbochs/usercorn/go/models"
+	"github.com/lunixbochs/usercorn/go/models/debug"
+)
+
+// TestSnapshotRoundTrip checks that SaveSnapshot/LoadSnapshot reproduce a
+// Replay's observable state (registers, PC, mapped memory contents), and
+// that an OpSnapshot built from those same bytes restores identically when
+// fed back through Feed - including when a later backward SeekIns lands on
+// the OpSnapshot's keyframe and has to restore via kf.Data (restoreFromBytes)
+// rather than replaying an Ops list.
+func TestSnapshotRoundTrip(t *testing.T) {
+	arch := testArch()
+	osv := &models.OS{}
+	dbg := &debug.Debug{}
+
+	rep := NewReplay(arch, osv, binary.LittleEndian, dbg)
+	rep.Feed(&OpMemMap{Addr: 0x1000, Size: 0x1000, Prot: 7, Desc: "test"})
+	rep.Feed(&OpReg{Num: 0, Val: 0xdead})
+	rep.Feed(&OpStep{Addr: 0, Size: 4})
+	rep.Feed(&OpMemWrite{Addr: 0x1000, Data: []byte{1, 2, 3, 4}})
+	rep.Feed(&OpStep{Addr: 4, Size: 4})
+
+	var buf bytes.Buffer
+	if err := rep.SaveSnapshot(&buf); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+	snapData := append([]byte{}, buf.Bytes()...)
+
+	loaded, err := LoadSnapshot(bytes.NewReader(snapData), arch, osv, binary.LittleEndian, dbg)
+	if err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+	if loaded.Inscount != rep.Inscount || loaded.PC != rep.PC || loaded.Regs[0] != rep.Regs[0] {
+		t.Fatalf("LoadSnapshot mismatch: got Inscount=%d PC=%#x Reg0=%#x, want Inscount=%d PC=%#x Reg0=%#x",
+			loaded.Inscount, loaded.PC, loaded.Regs[0], rep.Inscount, rep.PC, rep.Regs[0])
+	}
+	if got := loaded.Mem.MemRead(0x1000, 4); !bytesEqual(got, []byte{1, 2, 3, 4}) {
+		t.Fatalf("LoadSnapshot mem mismatch: got %v", got)
+	}
+
+	snapshotIns := rep.Inscount
+	rep.Feed(&OpSnapshot{Data: snapData})
+	rep.Feed(&OpStep{Addr: 8, Size: 4})
+	rep.Feed(&OpReg{Num: 0, Val: 0xbeef})
+	rep.Feed(&OpStep{Addr: 12, Size: 4})
+	afterIns := rep.Inscount
+
+	// Seek backward across the OpSnapshot's keyframe: rebuildTo must restore
+	// via kf.Data (restoreFromBytes), not an empty kf.Ops loop.
+	rep.SeekIns(snapshotIns)
+	if rep.Inscount != snapshotIns || rep.PC != 8 || rep.Regs[0] != 0xdead {
+		t.Fatalf("SeekIns(%d) across OpSnapshot: got Inscount=%d PC=%#x Reg0=%#x, want PC=%#x Reg0=%#x",
+			snapshotIns, rep.Inscount, rep.PC, rep.Regs[0], uint64(8), uint64(0xdead))
+	}
+	if got := rep.Mem.MemRead(0x1000, 4); !bytesEqual(got, []byte{1, 2, 3, 4}) {
+		t.Fatalf("SeekIns across OpSnapshot mem mismatch: got %v", got)
+	}
+
+	// ... and forward again, back past the point it was taken.
+	rep.SeekIns(afterIns)
+	if rep.PC != 16 || rep.Regs[0] != 0xbeef {
+		t.Fatalf("SeekIns forward past OpSnapshot: got PC=%#x Reg0=%#x, want PC=%#x Reg0=%#x", rep.PC, rep.Regs[0], uint64(16), uint64(0xbeef))
+	}
+}
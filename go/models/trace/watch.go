@@ -0,0 +1,312 @@
+package trace
+
+import "github.com/lunixbochs/usercorn/go/models"
+
+// WatchKind selects what triggers a memory watchpoint added with AddWatch.
+type WatchKind int
+
+const (
+	WatchWrite  WatchKind = iota // fires on any write into the range
+	WatchChange                  // fires only when the written bytes differ from the shadow copy
+)
+
+// WatchID/BreakID identify a registered watch or breakpoint so it can be
+// referenced again (currently just for bookkeeping; there's no RemoveWatch
+// yet because nothing in this package needed one).
+type WatchID int
+type BreakID int
+
+// HitEvent is what Hits delivers: which watch/break fired, at what
+// instruction/PC, and (for WatchChange watches, memory or register) the
+// old/new value that tripped it. Memory watches, and register watches hit
+// by an OpSpReg, populate Old/New; register watches hit by an OpReg
+// populate OldVal/NewVal.
+type HitEvent struct {
+	Inscount       uint64
+	PC             uint64
+	WatchID        WatchID // 0 if this hit came from a breakpoint instead
+	BreakID        BreakID // 0 if this hit came from a watch instead
+	Old, New       []byte  // populated for WatchChange memory and OpSpReg register hits
+	OldVal, NewVal uint64  // populated for WatchChange OpReg register hits
+}
+
+type memWatch struct {
+	id     WatchID
+	addr   uint64
+	size   uint64
+	kind   WatchKind
+	shadow []byte // only populated for WatchChange
+}
+
+type regWatch struct {
+	id   WatchID
+	reg  int
+	kind WatchKind
+	// shadow/hasShadow back WatchChange: hasShadow is false until the first
+	// OpReg/OpSpReg touching reg is seen, so that very first touch doesn't
+	// spuriously look like a change from a zero value.
+	hasShadow   bool
+	shadowVal   uint64
+	shadowBytes []byte
+}
+
+type breakpoint struct {
+	id   BreakID
+	pc   uint64
+	cond func(*Replay) bool
+}
+
+func (r *Replay) initWatches() {
+	r.watchMu.Lock()
+	defer r.watchMu.Unlock()
+	if r.hits == nil {
+		r.hits = make(chan HitEvent, subscriberBuffer)
+	}
+}
+
+// AddWatch triggers a HitEvent whenever an OpMemWrite overlaps
+// [addr, addr+size). With kind == WatchChange, it only fires when the
+// written bytes actually differ from what's currently there, by keeping a
+// shadow copy of the watched range and diffing on every write.
+func (r *Replay) AddWatch(addr, size uint64, kind WatchKind) WatchID {
+	r.initWatches()
+	w := &memWatch{addr: addr, size: size, kind: kind}
+	if kind == WatchChange {
+		w.shadow = append([]byte{}, r.Mem.MemRead(addr, size)...)
+	}
+	r.watchMu.Lock()
+	r.watchSeq++
+	w.id = WatchID(r.watchSeq)
+	r.memWatches = append(r.memWatches, w)
+	r.watchMu.Unlock()
+	return w.id
+}
+
+// AddRegWatch triggers a HitEvent whenever an OpReg/OpSpReg touches reg.
+// With kind == WatchChange, it only fires when the new value actually
+// differs from the last one seen, by keeping a shadow of the register
+// (uint64 for OpReg, raw bytes for OpSpReg) and diffing on each update.
+func (r *Replay) AddRegWatch(reg int, kind WatchKind) WatchID {
+	r.initWatches()
+	w := &regWatch{reg: reg, kind: kind}
+	r.watchMu.Lock()
+	r.watchSeq++
+	w.id = WatchID(r.watchSeq)
+	r.regWatches = append(r.regWatches, w)
+	r.watchMu.Unlock()
+	return w.id
+}
+
+// AddBreak triggers a HitEvent whenever an OpJmp/OpStep lands on pc and
+// cond (if non-nil) returns true. cond is evaluated after the PC change has
+// already been applied, so it can inspect r.Regs/r.Mem/r.Callstack as they
+// stand at that PC.
+func (r *Replay) AddBreak(pc uint64, cond func(*Replay) bool) BreakID {
+	r.initWatches()
+	b := &breakpoint{pc: pc, cond: cond}
+	r.watchMu.Lock()
+	r.breakSeq++
+	b.id = BreakID(r.breakSeq)
+	r.breaks = append(r.breaks, b)
+	r.watchMu.Unlock()
+	return b.id
+}
+
+// Hits delivers a HitEvent for every watch/breakpoint match, in the order
+// they occur. The channel is unbuffered-equivalent in spirit but backed by
+// a small buffer (subscriberBuffer) so a burst of hits during a fast replay
+// doesn't stall Feed(); callers that care about keeping up should drain it
+// promptly.
+func (r *Replay) Hits() <-chan HitEvent {
+	r.initWatches()
+	return r.hits
+}
+
+// checkWatches is called from update() for every applied op, so watchpoints
+// and breakpoints see state exactly as Replay itself sees it, without any
+// extra instrumentation of the emulator.
+func (r *Replay) checkWatches(op models.Op) {
+	if r.hits == nil {
+		return
+	}
+	r.watchMu.Lock()
+	memWatches := append([]*memWatch{}, r.memWatches...)
+	r.watchMu.Unlock()
+	switch o := op.(type) {
+	case *OpMemWrite:
+		for _, w := range memWatches {
+			lo, hi := w.addr, w.addr+w.size
+			end := o.Addr + uint64(len(o.Data))
+			if end <= lo || o.Addr >= hi {
+				continue
+			}
+			if w.kind == WatchChange {
+				cur := r.Mem.MemRead(w.addr, w.size)
+				if bytesEqual(cur, w.shadow) {
+					continue
+				}
+				old := w.shadow
+				w.shadow = append([]byte{}, cur...)
+				r.deliverHit(HitEvent{Inscount: r.Inscount, PC: r.PC, WatchID: w.id, Old: old, New: w.shadow})
+			} else {
+				r.deliverHit(HitEvent{Inscount: r.Inscount, PC: r.PC, WatchID: w.id})
+			}
+		}
+	case *OpReg:
+		r.checkRegWatch(int(o.Num), o.Val, nil)
+	case *OpSpReg:
+		r.checkRegWatch(int(o.Num), 0, o.Val)
+	case *OpJmp:
+		r.checkBreaks()
+	case *OpStep:
+		r.checkBreaks()
+	}
+}
+
+// checkRegWatch is fed the new value of an OpReg (val, bytes == nil) or
+// OpSpReg (bytes, val == 0) that just touched reg.
+func (r *Replay) checkRegWatch(reg int, val uint64, bytes []byte) {
+	r.watchMu.Lock()
+	regWatches := append([]*regWatch{}, r.regWatches...)
+	r.watchMu.Unlock()
+	for _, w := range regWatches {
+		if w.reg != reg {
+			continue
+		}
+		if w.kind != WatchChange {
+			r.deliverHit(HitEvent{Inscount: r.Inscount, PC: r.PC, WatchID: w.id})
+			continue
+		}
+		if bytes != nil {
+			if w.hasShadow && bytesEqual(bytes, w.shadowBytes) {
+				continue
+			}
+			old := w.shadowBytes
+			w.shadowBytes = append([]byte{}, bytes...)
+			w.hasShadow = true
+			r.deliverHit(HitEvent{Inscount: r.Inscount, PC: r.PC, WatchID: w.id, Old: old, New: w.shadowBytes})
+		} else {
+			if w.hasShadow && val == w.shadowVal {
+				continue
+			}
+			old := w.shadowVal
+			w.shadowVal = val
+			w.hasShadow = true
+			r.deliverHit(HitEvent{Inscount: r.Inscount, PC: r.PC, WatchID: w.id, OldVal: old, NewVal: val})
+		}
+	}
+}
+
+func (r *Replay) checkBreaks() {
+	r.watchMu.Lock()
+	breaks := append([]*breakpoint{}, r.breaks...)
+	r.watchMu.Unlock()
+	for _, b := range breaks {
+		if b.pc != r.PC {
+			continue
+		}
+		if b.cond != nil && !b.cond(r) {
+			continue
+		}
+		r.deliverHit(HitEvent{Inscount: r.Inscount, PC: r.PC, BreakID: b.id})
+	}
+}
+
+// maxHitLog bounds how many hits NextHit/PrevHit can see, trimming the
+// oldest once exceeded, so a hot watch/breakpoint in a long trace can't
+// grow hitLog (and the cost of scanning it) without bound.
+const maxHitLog = 1 << 16
+
+func (r *Replay) deliverHit(hit HitEvent) {
+	r.watchMu.Lock()
+	r.hitLog = append(r.hitLog, hit)
+	if len(r.hitLog) > maxHitLog {
+		r.hitLog = append([]HitEvent{}, r.hitLog[len(r.hitLog)-maxHitLog:]...)
+	}
+	r.watchMu.Unlock()
+	// drop-oldest to keep Feed() from blocking on a slow consumer,
+	// mirroring Subscribe's DeliverDropOldest semantics
+	for {
+		select {
+		case r.hits <- hit:
+			return
+		default:
+		}
+		select {
+		case <-r.hits:
+		default:
+		}
+	}
+}
+
+// resyncWatchShadows reseeds every WatchChange watch's shadow from the live
+// state, without delivering any hits. It's called at the end of rebuildTo,
+// after Mem/Regs/SpRegs have been restored to whatever they were at the
+// target instruction: without this, a watch's shadow would still hold the
+// value from whatever instruction Replay stood at *before* the seek, so the
+// first checkWatches call afterwards (e.g. from a subsequent seekForward,
+// which doesn't set r.seeking) would diff the now-current state against a
+// shadow from the wrong point in time, producing a wrong or entirely
+// spurious/missing Old/New.
+func (r *Replay) resyncWatchShadows() {
+	r.watchMu.Lock()
+	defer r.watchMu.Unlock()
+	for _, w := range r.memWatches {
+		if w.kind == WatchChange {
+			w.shadow = append([]byte{}, r.Mem.MemRead(w.addr, w.size)...)
+		}
+	}
+	for _, w := range r.regWatches {
+		if w.kind != WatchChange {
+			continue
+		}
+		if v, ok := r.SpRegs[w.reg]; ok {
+			w.shadowBytes = append([]byte{}, v...)
+			w.hasShadow = true
+		}
+		if v, ok := r.Regs[w.reg]; ok {
+			w.shadowVal = v
+			w.hasShadow = true
+		}
+	}
+}
+
+func bytesEqual(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// NextHit returns the first recorded hit strictly after the instruction
+// Replay currently stands at, or (HitEvent{}, false) if there isn't one.
+// It does not move Replay; call SeekIns(hit.Inscount) to actually jump
+// there.
+func (r *Replay) NextHit() (HitEvent, bool) {
+	r.watchMu.Lock()
+	defer r.watchMu.Unlock()
+	for _, h := range r.hitLog {
+		if h.Inscount > r.Inscount {
+			return h, true
+		}
+	}
+	return HitEvent{}, false
+}
+
+// PrevHit returns the last recorded hit strictly before the instruction
+// Replay currently stands at, or (HitEvent{}, false) if there isn't one.
+func (r *Replay) PrevHit() (HitEvent, bool) {
+	r.watchMu.Lock()
+	defer r.watchMu.Unlock()
+	for i := len(r.hitLog) - 1; i >= 0; i-- {
+		if r.hitLog[i].Inscount < r.Inscount {
+			return r.hitLog[i], true
+		}
+	}
+	return HitEvent{}, false
+}